@@ -6,15 +6,33 @@ import (
 	"errors"
 	"fmt"
 	"io"
-
+	"log"
+	"regexp"
 	"strings"
+	"sync"
 )
 
 const (
 	sqlCmdPrefix        = "-- +migrate "
 	optionNoTransaction = "notransaction"
+
+	// maxScanTokenSize is the largest single line ParseMigration will accept.
+	// bufio.Scanner's own default (64 KiB) is too small for migrations that
+	// embed long generated statements (bulk enum seed data, extension DDL,
+	// base64-encoded blobs), so we hand it a much larger buffer instead.
+	maxScanTokenSize = 4 * 1024 * 1024
 )
 
+// scanBufferPool recycles the large buffers ParseMigration hands to
+// bufio.Scanner so parsing many migrations in a row doesn't repeatedly
+// allocate multi-megabyte slices.
+var scanBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxScanTokenSize)
+		return &buf
+	},
+}
+
 type migrationStatement struct {
 	Statement   string
 	Loop        bool
@@ -30,23 +48,77 @@ type ParsedMigration struct {
 	DisableTransactionDown bool
 }
 
-var (
+// Parser holds the configuration ParseMigration runs with. The zero value is
+// a ready to use Parser with the same behavior as the package-level
+// ParseMigration function, so callers that don't need Verbose logging or a
+// custom LineSeparator can keep calling that instead.
+type Parser struct {
 	// LineSeparator can be used to split migrations by an exact line match. This line
 	// will be removed from the output. If left blank, it is not considered. It is defaulted
 	// to blank so you will have to set it manually.
 	// Use case: in MSSQL, it is convenient to separate commands by GO statements like in
 	// SQL Query Analyzer.
-	LineSeparator = ""
-)
+	LineSeparator string
+
+	// Verbose, when true, logs every state machine transition via the
+	// standard log package. Intended for debugging malformed migrations.
+	Verbose bool
+
+	// Substitutions replaces each ${VAR} reference in the script with its
+	// value before the line is handed to the state machine, so a single
+	// migration file can be parameterized for things like schema names,
+	// tablespaces, or other environment-specific identifiers without the
+	// caller having to template the SQL itself.
+	Substitutions map[string]string
+
+	// StrictSubstitutions, when true, makes a ${VAR} reference with no entry
+	// in Substitutions a parse error. When false (the default), unresolved
+	// references are left in the output verbatim.
+	StrictSubstitutions bool
+
+	// Tags selects which '-- +migrate EnvBegin'/'EnvEnd' blocks are kept,
+	// keyed by the same key=value pairs given on the EnvBegin directive
+	// (e.g. '-- +migrate EnvBegin dialect=postgres' is included only if
+	// Tags["dialect"] == "postgres"). A block whose tags don't all match is
+	// still parsed, so malformed nesting inside it is still reported, but
+	// its statements are dropped instead of being returned.
+	Tags map[string]string
+}
+
+// substitutionPattern matches ${VAR}-style references for Parser.Substitutions.
+var substitutionPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substitute replaces ${VAR} references in line using p.Substitutions.
+func (p *Parser) substitute(line string) (string, error) {
+	if len(p.Substitutions) == 0 && !p.StrictSubstitutions {
+		return line, nil
+	}
 
-func errNoTerminator() error {
-	if len(LineSeparator) == 0 {
+	var unresolved string
+	substituted := substitutionPattern.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if value, ok := p.Substitutions[name]; ok {
+			return value
+		}
+		unresolved = name
+		return ref
+	})
+
+	if unresolved != "" && p.StrictSubstitutions {
+		return "", fmt.Errorf("ERROR: no substitution provided for ${%s}", unresolved)
+	}
+
+	return substituted, nil
+}
+
+func (p *Parser) errNoTerminator() error {
+	if len(p.LineSeparator) == 0 {
 		return errors.New(`ERROR: The last statement must be ended by a semicolon or '-- +migrate StatementEnd' marker.
 			See https://github.com/j-whitehouse/sql-migrate for details.`)
 	}
 
 	return errors.New(fmt.Sprintf(`ERROR: The last statement must be ended by a semicolon, a line whose contents are %q, or '-- +migrate StatementEnd' marker.
-			See https://github.com/j-whitehouse/sql-migrate for details.`, LineSeparator))
+			See https://github.com/j-whitehouse/sql-migrate for details.`, p.LineSeparator))
 }
 
 // Checks the line to see if the line has a statement-ending semicolon
@@ -68,17 +140,201 @@ func endsWithSemicolon(line string) bool {
 	return strings.HasSuffix(prev, ";")
 }
 
+// parserState is a single state of the migration state machine. The state
+// encodes both which half of the migration we're in (Up/Down) and whether
+// we're currently inside a StatementBegin/End, LoopBegin/End or
+// ConditionalBegin/End block, so that illegal nesting (e.g. a StatementBegin
+// inside a loop) can be rejected by the transition table rather than by a
+// scattered set of guard clauses.
+type parserState int
+
+const (
+	// gooseUp is also the state the machine starts in: any SQL preceding the
+	// first '-- +migrate Up'/'Down' annotation (or a migration with no
+	// annotations at all) is treated as an implicit Up statement, for
+	// flyway script compatibility :-(
+	gooseUp parserState = iota
+	gooseStatementBeginUp
+	gooseStatementEndUp
+	gooseLoopUp
+	gooseConditionalUp
+	gooseDown
+	gooseStatementBeginDown
+	gooseStatementEndDown
+	gooseLoopDown
+	gooseConditionalDown
+)
+
+func (s parserState) String() string {
+	switch s {
+	case gooseUp:
+		return "gooseUp"
+	case gooseStatementBeginUp:
+		return "gooseStatementBeginUp"
+	case gooseStatementEndUp:
+		return "gooseStatementEndUp"
+	case gooseLoopUp:
+		return "gooseLoopUp"
+	case gooseConditionalUp:
+		return "gooseConditionalUp"
+	case gooseDown:
+		return "gooseDown"
+	case gooseStatementBeginDown:
+		return "gooseStatementBeginDown"
+	case gooseStatementEndDown:
+		return "gooseStatementEndDown"
+	case gooseLoopDown:
+		return "gooseLoopDown"
+	case gooseConditionalDown:
+		return "gooseConditionalDown"
+	default:
+		return fmt.Sprintf("parserState(%d)", int(s))
+	}
+}
+
+// direction reports which half of the migration a state belongs to.
+func (s parserState) direction() migrationDirection {
+	switch s {
+	case gooseUp, gooseStatementBeginUp, gooseStatementEndUp, gooseLoopUp, gooseConditionalUp:
+		return directionUp
+	case gooseDown, gooseStatementBeginDown, gooseStatementEndDown, gooseLoopDown, gooseConditionalDown:
+		return directionDown
+	default:
+		panic("sqlparse: state has no direction")
+	}
+}
+
+// isDown reports whether a state belongs to the Down half of a migration.
+// Callers use it to pick a tentative next state before validating the
+// transition through the state machine.
+func (s parserState) isDown() bool {
+	switch s {
+	case gooseDown, gooseStatementBeginDown, gooseStatementEndDown, gooseLoopDown, gooseConditionalDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// atTopLevel reports whether a state is outside of any open StatementBegin/
+// LoopBegin/ConditionalBegin block, so an EnvBegin/EnvEnd directive is legal
+// there. gooseStatementEndUp/Down count as top-level too: the statement they
+// close is emitted on the StatementEnd line itself and the block is shut, and
+// the machine stays in that state until the next directive, so an
+// EnvBegin/EnvEnd seen there is not nested inside anything.
+func (s parserState) atTopLevel() bool {
+	switch s {
+	case gooseUp, gooseDown, gooseStatementEndUp, gooseStatementEndDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// inBlock reports whether semicolons should be ignored while in this state,
+// i.e. we're inside a StatementBegin/End, LoopBegin/End or
+// ConditionalBegin/End block.
+func (s parserState) inBlock() bool {
+	switch s {
+	case gooseStatementBeginUp, gooseLoopUp, gooseConditionalUp,
+		gooseStatementBeginDown, gooseLoopDown, gooseConditionalDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// transitions enumerates the legal next states for every state. Up and Down
+// are exact mirrors of one another. Any transition not listed here is
+// rejected by stateMachine.Set with a precise "unexpected X in state Y"
+// error.
+var transitions = map[parserState][]parserState{
+	gooseUp:               {gooseUp, gooseDown, gooseStatementBeginUp, gooseLoopUp},
+	gooseStatementBeginUp: {gooseStatementEndUp},
+	gooseStatementEndUp:   {gooseUp, gooseDown, gooseStatementBeginUp, gooseLoopUp},
+	gooseLoopUp:           {gooseConditionalUp, gooseUp},
+	gooseConditionalUp:    {gooseLoopUp},
+
+	gooseDown:               {gooseUp, gooseDown, gooseStatementBeginDown, gooseLoopDown},
+	gooseStatementBeginDown: {gooseStatementEndDown},
+	gooseStatementEndDown:   {gooseUp, gooseDown, gooseStatementBeginDown, gooseLoopDown},
+	gooseLoopDown:           {gooseConditionalDown, gooseDown},
+	gooseConditionalDown:    {gooseLoopDown},
+}
+
+// stateMachine tracks the current parserState and rejects illegal
+// transitions centrally, instead of relying on a pile of ad-hoc booleans and
+// guard clauses scattered through the parse loop.
+type stateMachine struct {
+	current parserState
+	verbose bool
+}
+
+func newStateMachine(verbose bool) *stateMachine {
+	return &stateMachine{current: gooseUp, verbose: verbose}
+}
+
+// Get returns the current state.
+func (m *stateMachine) Get() parserState {
+	return m.current
+}
+
+// Set transitions the machine to newState, returning an error if that edge
+// isn't legal from the current state.
+func (m *stateMachine) Set(newState parserState) error {
+	for _, allowed := range transitions[m.current] {
+		if allowed == newState {
+			if m.verbose {
+				log.Printf("sqlparse: %s -> %s", m.current, newState)
+			}
+			m.current = newState
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ERROR: unexpected %s in state %s", newState, m.current)
+}
+
 type migrationDirection int
 
 const (
-	directionNone migrationDirection = iota
-	directionUp
+	directionUp migrationDirection = iota
 	directionDown
 )
 
+// Direction selects which half of a migration - Up or Down - an operation
+// applies to.
+type Direction string
+
+const (
+	DirectionUp   Direction = "up"
+	DirectionDown Direction = "down"
+)
+
+// FromBool converts the common bool representation of a migration direction
+// (true meaning Up, false meaning Down) into a Direction.
+func FromBool(up bool) Direction {
+	if up {
+		return DirectionUp
+	}
+	return DirectionDown
+}
+
+func (d Direction) internal() migrationDirection {
+	if d == DirectionDown {
+		return directionDown
+	}
+	return directionUp
+}
+
 type migrateCommand struct {
 	Command string
 	Options []string
+
+	// KeyValues holds the key=value options (e.g. "dialect=postgres" on an
+	// EnvBegin directive), as opposed to bare flags like "notransaction"
+	// which are kept in Options instead.
+	KeyValues map[string]string
 }
 
 func (c *migrateCommand) HasOption(opt string) bool {
@@ -91,6 +347,18 @@ func (c *migrateCommand) HasOption(opt string) bool {
 	return false
 }
 
+// tagsMatch reports whether every key=value option on the command matches
+// tags. A command with no key=value options matches trivially.
+func (c *migrateCommand) tagsMatch(tags map[string]string) bool {
+	for key, value := range c.KeyValues {
+		if tags[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
 func parseCommand(line string) (*migrateCommand, error) {
 	cmd := &migrateCommand{}
 
@@ -105,7 +373,18 @@ func parseCommand(line string) (*migrateCommand, error) {
 
 	cmd.Command = fields[0]
 
-	cmd.Options = fields[1:]
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			cmd.Options = append(cmd.Options, field)
+			continue
+		}
+
+		if cmd.KeyValues == nil {
+			cmd.KeyValues = make(map[string]string)
+		}
+		cmd.KeyValues[key] = value
+	}
 
 	return cmd, nil
 }
@@ -120,27 +399,147 @@ func parseCommand(line string) (*migrateCommand, error) {
 // within a statement. For these cases, we provide the explicit annotations
 // 'StatementBegin' and 'StatementEnd' to allow the script to
 // tell us to ignore semicolons.
+//
+// ParseMigration is a thin wrapper around (&Parser{}).ParseMigration, kept
+// for callers that don't need a custom LineSeparator or Verbose logging.
 func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
-	p := &ParsedMigration{}
+	return (&Parser{}).ParseMigration(r)
+}
+
+// ParseStatements is a thin wrapper around (&Parser{}).ParseStatements, kept
+// for callers that don't need a custom LineSeparator or Verbose logging.
+func ParseStatements(r io.Reader, fn func(stmt migrationStatement, down bool) error) error {
+	return (&Parser{}).ParseStatements(r, fn)
+}
+
+// ParseMigrationDirection is a thin wrapper around
+// (&Parser{}).ParseMigrationDirection, kept for callers that don't need a
+// custom LineSeparator or Verbose logging.
+func ParseMigrationDirection(r io.ReadSeeker, dir Direction) ([]migrationStatement, bool, error) {
+	return (&Parser{}).ParseMigrationDirection(r, dir)
+}
+
+// ParseMigration splits the given sql script into individual statements
+// according to p's configuration. See the package-level ParseMigration for
+// the statement-splitting rules. It runs the same internal parse loop as
+// ParseStatements and buffers every statement into a ParsedMigration.
+func (p *Parser) ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
+	if _, err := r.Seek(0, 0); err != nil {
+		return nil, err
+	}
 
-	_, err := r.Seek(0, 0)
+	parsed := &ParsedMigration{}
+	disableUp, disableDown, err := p.parse(r, nil, func(stmt migrationStatement, down bool) error {
+		if down {
+			parsed.DownStatements = append(parsed.DownStatements, stmt)
+		} else {
+			parsed.UpStatements = append(parsed.UpStatements, stmt)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// new migrationStatement type requires both
+	parsed.DisableTransactionUp = disableUp
+	parsed.DisableTransactionDown = disableDown
+
+	return parsed, nil
+}
+
+// ParseStatements streams the statements in r one at a time via fn instead of
+// buffering the whole script into a ParsedMigration. fn is called with each
+// statement in file order as soon as its terminator is seen, and with
+// down=true for statements belonging to the Down half. If fn returns a
+// non-nil error, parsing stops immediately and that error is returned.
+//
+// This lets a migration runner execute (and discard) each statement without
+// ever holding the full set of statements in memory, which matters for large
+// seed-data migrations. It shares the same state-machine parsing rules as
+// ParseMigration, including StatementBegin/End, LoopBegin/End and
+// ConditionalBegin/End.
+func (p *Parser) ParseStatements(r io.Reader, fn func(stmt migrationStatement, down bool) error) error {
+	_, _, err := p.parse(r, nil, fn)
+	return err
+}
+
+// ParseMigrationDirection parses only the statements belonging to dir,
+// returning them along with the DisableTransaction flag for that half. The
+// other half of the migration is still scanned line by line - so an
+// unterminated StatementBegin/LoopBegin/ConditionalBegin/EnvBegin there is
+// still reported as a parse error - but its statement text is never
+// buffered or emitted, so it only adds a state-machine pass over those
+// lines rather than doubling the memory and copy work ParseMigration does.
+func (p *Parser) ParseMigrationDirection(r io.ReadSeeker, dir Direction) ([]migrationStatement, bool, error) {
+	if _, err := r.Seek(0, 0); err != nil {
+		return nil, false, err
+	}
+
+	want := dir.internal()
+
+	var statements []migrationStatement
+	disableUp, disableDown, err := p.parse(r, &want, func(stmt migrationStatement, down bool) error {
+		statements = append(statements, stmt)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if want == directionDown {
+		return statements, disableDown, nil
+	}
+	return statements, disableUp, nil
+}
+
+// parse drives the state machine over r, invoking emit for every completed
+// statement, and returns the DisableTransactionUp/Down flags gathered along
+// the way. If only is non-nil, lines belonging to the other direction are
+// never appended to statementBuf/conditionalBuf and never passed to emit -
+// only the state machine still runs over them, so block structure errors
+// (an unterminated StatementBegin/LoopBegin/ConditionalBegin/EnvBegin) are
+// still reported for the direction that's being skipped.
+func (p *Parser) parse(r io.Reader, only *migrationDirection, emit func(stmt migrationStatement, down bool) error) (disableUp, disableDown bool, err error) {
 	var statementBuf bytes.Buffer
 	var conditionalBuf bytes.Buffer
+
+	sm := newStateMachine(p.Verbose)
+
 	scanner := bufio.NewScanner(r)
+	bufPtr := scanBufferPool.Get().(*[]byte)
+	defer scanBufferPool.Put(bufPtr)
+	scanner.Buffer(*bufPtr, maxScanTokenSize)
 
 	statementEnded := false
-	ignoreSemicolons := false
-	currentDirection := directionUp // For flyway script compatibility :-(
+
+	// isLoop/isConditional mirror the corresponding Loop/Conditional states.
+	// isConditional is cleared as soon as ConditionalEnd is seen, since the
+	// rest of the loop body goes back to statementBuf. isLoop, unlike the
+	// stateMachine, is only cleared once the statement that closed the loop
+	// has been emitted, not the instant LoopEnd transitions sm. sm.Get() has
+	// already moved on to
+	// gooseUp/gooseDown by the time a LoopEnd line reaches the emit step
+	// below, so deriving isLoop from sm.Get() there would mislabel the
+	// loop's own closing statement as Loop: false.
 	isLoop := false
 	isConditional := false
 
+	// envOpen/envInclude track an optional '-- +migrate EnvBegin'/'EnvEnd'
+	// wrapper around the current position. They're deliberately kept as a
+	// layer alongside the stateMachine, rather than doubled-up parserState
+	// values, since an env block can wrap either direction's plain,
+	// StatementBegin or LoopBegin states without changing any of their
+	// existing transition rules - only StatementBegin/LoopBegin/
+	// ConditionalBegin may nest inside an env block, never the reverse.
+	envOpen := false
+	envInclude := true
+
 	for scanner.Scan() {
-		line := scanner.Text()
+		line, err := p.substitute(scanner.Text())
+		if err != nil {
+			return false, false, err
+		}
+
 		// ignore comment except beginning with '-- +'
 		if strings.HasPrefix(line, "-- ") && !strings.HasPrefix(line, "-- +") {
 			continue
@@ -150,112 +549,180 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 		if strings.HasPrefix(line, sqlCmdPrefix) {
 			cmd, err := parseCommand(line)
 			if err != nil {
-				return nil, err
+				return false, false, err
 			}
 
 			switch cmd.Command {
 			case "Up":
 				if len(strings.TrimSpace(statementBuf.String())) > 0 {
-					return nil, errNoTerminator()
+					return false, false, p.errNoTerminator()
+				}
+				if err := sm.Set(gooseUp); err != nil {
+					return false, false, err
 				}
-				currentDirection = directionUp
 				if cmd.HasOption(optionNoTransaction) {
-					p.DisableTransactionUp = true
+					disableUp = true
 				}
-				break
 
 			case "Down":
 				if len(strings.TrimSpace(statementBuf.String())) > 0 {
-					return nil, errNoTerminator()
+					return false, false, p.errNoTerminator()
+				}
+				if err := sm.Set(gooseDown); err != nil {
+					return false, false, err
 				}
-				currentDirection = directionDown
 				if cmd.HasOption(optionNoTransaction) {
-					p.DisableTransactionDown = true
+					disableDown = true
 				}
-				break
 
 			case "StatementBegin":
-				if isLoop || isConditional {
-					return nil, errors.New("ERROR: Cannot begin a statement block inside a loop or conditional block")
+				next := gooseStatementBeginUp
+				if sm.Get().isDown() {
+					next = gooseStatementBeginDown
 				}
-				if currentDirection != directionNone {
-					ignoreSemicolons = true
+				if err := sm.Set(next); err != nil {
+					return false, false, err
 				}
-				break
 
 			case "StatementEnd":
-				if isLoop || isConditional {
-					break
+				// A StatementEnd seen while not inside a StatementBegin block
+				// (including inside a loop or conditional, which piggyback on
+				// their own Begin/End pair) is tolerated as a no-op.
+				if cur := sm.Get(); cur == gooseStatementBeginUp || cur == gooseStatementBeginDown {
+					next := gooseStatementEndUp
+					if cur == gooseStatementBeginDown {
+						next = gooseStatementEndDown
+					}
+					if err := sm.Set(next); err != nil {
+						return false, false, err
+					}
+					statementEnded = true
+				}
+
+			case "LoopBegin":
+				next := gooseLoopUp
+				if sm.Get().isDown() {
+					next = gooseLoopDown
 				}
-				if currentDirection != directionNone {
-					statementEnded = (ignoreSemicolons == true)
-					ignoreSemicolons = false
+				if err := sm.Set(next); err != nil {
+					return false, false, err
+				}
+				isLoop = true
+				// A loop inside a non-matching EnvBegin block is dropped along
+				// with the rest of that block's statements below, so it must
+				// not disable transactions for a direction whose migration
+				// never actually sees it.
+				if envInclude {
+					if sm.Get().direction() == directionUp {
+						disableUp = true
+					} else {
+						disableDown = true
+					}
 				}
-				break
+
+			case "LoopEnd":
+				switch cur := sm.Get(); cur {
+				case gooseLoopUp, gooseLoopDown:
+					next := gooseUp
+					if cur == gooseLoopDown {
+						next = gooseDown
+					}
+					if err := sm.Set(next); err != nil {
+						return false, false, err
+					}
+					// isLoop stays true here: this LoopEnd line closes the
+					// loop's own statement, which must still be emitted
+					// with Loop: true. It's cleared below once that
+					// statement has actually been appended.
+					statementEnded = true
+				case gooseConditionalUp, gooseConditionalDown:
+					return false, false, errors.New("ERROR: saw '-- +migrate ConditionalBegin' with no matching '-- +migrate ConditionalEnd' inside its loop")
+				}
+				// A stray LoopEnd outside of a loop is otherwise tolerated,
+				// matching the leniency migration authors have relied on
+				// historically.
 
 			case "ConditionalBegin":
-				if !isLoop {
-					return nil, errors.New("ERROR: saw '-- +migration ConditionalBegin' outside of matching '-- +migrate LoopBegin'")
+				next := gooseConditionalUp
+				if sm.Get().isDown() {
+					next = gooseConditionalDown
+				}
+				if err := sm.Set(next); err != nil {
+					return false, false, err
 				}
 				isConditional = true
+
 			case "ConditionalEnd":
-				// don't care if ends without beginning
-				isConditional = false
-			case "LoopBegin":
-				if ignoreSemicolons {
-					return nil, errors.New("ERROR: Cannot begin a loop inside another loop or statement block")
-				}
-				if currentDirection != directionNone {
-					isLoop = true
-					ignoreSemicolons = true // Piggy backing on same logic as statements
-					if currentDirection == directionUp {
-						p.DisableTransactionUp = true
-					} else if currentDirection == directionDown {
-						p.DisableTransactionDown = true
+				// Don't care if it ends without a matching ConditionalBegin.
+				if cur := sm.Get(); cur == gooseConditionalUp || cur == gooseConditionalDown {
+					isConditional = false
+					next := gooseLoopUp
+					if cur == gooseConditionalDown {
+						next = gooseLoopDown
+					}
+					if err := sm.Set(next); err != nil {
+						return false, false, err
 					}
 				}
 
-				break
-			case "LoopEnd":
-				if isConditional {
-					return nil, errors.New("ERROR: saw '-- +migrate ConditionalBegin' with no matching '-- +migrate ConditionalEnd' inside its loop")
+			case "EnvBegin":
+				if envOpen {
+					return false, false, errors.New("ERROR: saw '-- +migrate EnvBegin' nested inside another EnvBegin")
+				}
+				if cur := sm.Get(); !cur.atTopLevel() {
+					return false, false, fmt.Errorf("ERROR: unexpected EnvBegin in state %s", cur)
 				}
-				// Need to avoid _ending_ a loop outside loops as we could mess up statement blocks
-				if !isLoop {
+				envOpen = true
+				envInclude = cmd.tagsMatch(p.Tags)
+
+			case "EnvEnd":
+				if !envOpen {
+					// Tolerated as a no-op, matching the leniency given to a
+					// stray LoopEnd/ConditionalEnd.
 					break
 				}
-				if currentDirection != directionNone {
-					// Piggy backing on same logic as statements
-					statementEnded = (ignoreSemicolons == true)
-					ignoreSemicolons = false
+				if cur := sm.Get(); !cur.atTopLevel() {
+					return false, false, fmt.Errorf("ERROR: saw '-- +migrate EnvEnd' with an unclosed StatementBegin/LoopBegin inside it, in state %s", cur)
 				}
-				break
+				// A dropped block's trailing SQL must never survive past its
+				// EnvEnd: if it were left in statementBuf it would silently
+				// glue onto whatever statement comes next, the same class of
+				// bug the Up/Down cases above guard against.
+				if !envInclude && len(strings.TrimSpace(statementBuf.String())) > 0 {
+					return false, false, p.errNoTerminator()
+				}
+				envOpen = false
+				envInclude = true
 			}
 		}
 
-		if currentDirection == directionNone {
-			continue
-		}
+		state := sm.Get()
+		ignoreSemicolons := state.inBlock()
+
+		isLineSeparator := !ignoreSemicolons && len(p.LineSeparator) > 0 && line == p.LineSeparator
 
-		isLineSeparator := !ignoreSemicolons && len(LineSeparator) > 0 && line == LineSeparator
+		// A direction that's been filtered out by `only` only needs its
+		// state transitions tracked above, never its actual text - skip
+		// growing the buffers for it entirely.
+		wanted := only == nil || state.direction() == *only
 
 		// Append additional query text to query buffer
 		// Not worried about isConditional, as only true with isLoop
-		if !isLineSeparator && !strings.HasPrefix(line, "-- +") && !isLoop {
+		if wanted && !isLineSeparator && !strings.HasPrefix(line, "-- +") && !isLoop {
 			if _, err := statementBuf.WriteString(line + "\n"); err != nil {
-				return nil, err
+				return false, false, err
 			}
 		}
 
 		// Inside a loop need to pick query v. conditional text
-		if isLoop {
+		if wanted && isLoop {
 			if isConditional {
 				if _, err := conditionalBuf.WriteString(line + "\n"); err != nil {
-					return nil, err
+					return false, false, err
 				}
 			} else {
 				if _, err := statementBuf.WriteString(line + "\n"); err != nil {
-					return nil, err
+					return false, false, err
 				}
 			}
 		}
@@ -270,55 +737,49 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 		*/
 		if (!ignoreSemicolons && (endsWithSemicolon(line) || isLineSeparator)) || statementEnded {
 			statementEnded = false
-			switch currentDirection {
-			case directionUp:
-				newStatement := migrationStatement{statementBuf.String(), isLoop, conditionalBuf.String()}
-				p.UpStatements = append(p.UpStatements, newStatement)
 
-			case directionDown:
+			// Statements from a non-matching EnvBegin block, or from the
+			// direction `only` filtered out, are dropped rather than
+			// emitted, though they're still parsed above so malformed
+			// nesting inside them is still caught.
+			if envInclude && wanted {
 				newStatement := migrationStatement{statementBuf.String(), isLoop, conditionalBuf.String()}
-				p.DownStatements = append(p.DownStatements, newStatement)
-
-			default:
-				panic("impossible state")
+				if err := emit(newStatement, state.direction() == directionDown); err != nil {
+					return false, false, err
+				}
 			}
 
 			isLoop = false
+			isConditional = false
 			statementBuf.Reset()
 			conditionalBuf.Reset()
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	// diagnose likely migration script errors
-	if ignoreSemicolons {
-		return nil, errors.New("ERROR: saw '-- +migrate StatementBegin' with no matching '-- +migrate StatementEnd'")
-	}
-
-	// validate no unclosed loop
-	if isLoop {
-		return nil, errors.New("ERROR: saw '-- +migrate LoopBegin' with no matching '-- +migrate LoopEnd'")
+		return false, false, err
 	}
 
-	// validate no unclosed conditional
-	if isConditional {
-		return nil, errors.New("ERROR: saw '-- +migrate ConditionalBegin' with no matching '-- +migrate ConditionalEnd'")
+	if envOpen {
+		return false, false, errors.New("ERROR: saw '-- +migrate EnvBegin' with no matching '-- +migrate EnvEnd'")
 	}
 
-	if currentDirection == directionNone {
-		return nil, errors.New(`ERROR: no Up/Down annotations found, so no statements were executed.
-			See https://github.com/j-whitehouse/sql-migrate for details`)
+	// diagnose likely migration script errors
+	switch sm.Get() {
+	case gooseStatementBeginUp, gooseStatementBeginDown:
+		return false, false, errors.New("ERROR: saw '-- +migrate StatementBegin' with no matching '-- +migrate StatementEnd'")
+	case gooseLoopUp, gooseLoopDown:
+		return false, false, errors.New("ERROR: saw '-- +migrate LoopBegin' with no matching '-- +migrate LoopEnd'")
+	case gooseConditionalUp, gooseConditionalDown:
+		return false, false, errors.New("ERROR: saw '-- +migrate ConditionalBegin' with no matching '-- +migrate ConditionalEnd'")
 	}
 
 	// allow comment without sql instruction. Example:
 	// -- +migrate Down
 	// -- nothing to downgrade!
 	if len(strings.TrimSpace(statementBuf.String())) > 0 && !strings.HasPrefix(statementBuf.String(), "-- +") {
-		return nil, errNoTerminator()
+		return false, false, p.errNoTerminator()
 	}
 
-	return p, nil
+	return disableUp, disableDown, nil
 }
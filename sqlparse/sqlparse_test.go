@@ -0,0 +1,280 @@
+package sqlparse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoopBeginEndSetsLoopFlag(t *testing.T) {
+	migration := `
+-- +migrate Up
+-- +migrate LoopBegin
+SELECT 1;
+-- +migrate ConditionalBegin
+SELECT count(*) FROM information_schema.tables WHERE table_name = 'foo';
+-- +migrate ConditionalEnd
+-- +migrate LoopEnd
+
+-- +migrate Down
+SELECT 1;
+`
+	parsed, err := ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if len(parsed.UpStatements) != 1 {
+		t.Fatalf("expected 1 up statement, got %d", len(parsed.UpStatements))
+	}
+	if !parsed.UpStatements[0].Loop {
+		t.Errorf("expected the loop's statement to have Loop=true, got false")
+	}
+	if parsed.UpStatements[0].Conditional == "" {
+		t.Errorf("expected the loop's statement to carry its Conditional text")
+	}
+}
+
+func TestNoAnnotationsDefaultsToUp(t *testing.T) {
+	migration := `
+SELECT 1;
+SELECT 2;
+`
+	parsed, err := ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if len(parsed.UpStatements) != 2 {
+		t.Fatalf("expected 2 up statements for a flyway-style migration with no annotations, got %d", len(parsed.UpStatements))
+	}
+	if len(parsed.DownStatements) != 0 {
+		t.Fatalf("expected no down statements, got %d", len(parsed.DownStatements))
+	}
+}
+
+func TestSubstitutionsReplaceVarReferences(t *testing.T) {
+	migration := `-- +migrate Up
+CREATE TABLE ${SCHEMA}.foo (id int);
+
+-- +migrate Down
+DROP TABLE ${SCHEMA}.foo;
+`
+	p := &Parser{Substitutions: map[string]string{"SCHEMA": "public"}}
+
+	parsed, err := p.ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if got, want := parsed.UpStatements[0].Statement, "CREATE TABLE public.foo (id int);\n"; got != want {
+		t.Errorf("expected ${SCHEMA} to be substituted, got %q, want %q", got, want)
+	}
+	if got, want := parsed.DownStatements[0].Statement, "\nDROP TABLE public.foo;\n"; got != want {
+		t.Errorf("expected ${SCHEMA} to be substituted, got %q, want %q", got, want)
+	}
+}
+
+func TestStrictSubstitutionsRejectsUnresolvedRefEvenWithoutAnySubstitutions(t *testing.T) {
+	migration := `
+-- +migrate Up
+SELECT '${A}';
+`
+	p := &Parser{StrictSubstitutions: true}
+
+	if _, err := p.ParseMigration(bytes.NewReader([]byte(migration))); err == nil {
+		t.Fatalf("expected an error for an unresolved ${A} reference with StrictSubstitutions set, got nil")
+	}
+}
+
+func TestExcludedEnvBlockDoesNotLeakLoopTransactionFlag(t *testing.T) {
+	migration := `
+-- +migrate Up
+-- +migrate EnvBegin env=prod
+-- +migrate LoopBegin
+SELECT 1;
+-- +migrate LoopEnd
+-- +migrate EnvEnd
+SELECT 2;
+
+-- +migrate Down
+SELECT 1;
+`
+	p := &Parser{Tags: map[string]string{"env": "test"}}
+
+	parsed, err := p.ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if parsed.DisableTransactionUp {
+		t.Errorf("LoopBegin inside a non-matching EnvBegin block must not disable transactions for that direction")
+	}
+	if len(parsed.UpStatements) != 1 || parsed.UpStatements[0].Statement != "SELECT 2;\n" {
+		t.Fatalf("expected only the statement outside the excluded env block to be kept, got %#v", parsed.UpStatements)
+	}
+}
+
+func TestEnvBlockIsKeptWhenTagsMatch(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=postgres
+SELECT 1;
+-- +migrate EnvEnd
+`
+	p := &Parser{Tags: map[string]string{"dialect": "postgres"}}
+
+	parsed, err := p.ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if len(parsed.UpStatements) != 1 || parsed.UpStatements[0].Statement != "SELECT 1;\n" {
+		t.Fatalf("expected the matching-tag env block to be kept, got %#v", parsed.UpStatements)
+	}
+}
+
+func TestStatementBeginNestsInsideAnIncludedEnvBlock(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=postgres
+-- +migrate StatementBegin
+CREATE FUNCTION foo() RETURNS int AS $$
+BEGIN
+  RETURN 1;
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+-- +migrate EnvEnd
+`
+	p := &Parser{Tags: map[string]string{"dialect": "postgres"}}
+
+	parsed, err := p.ParseMigration(bytes.NewReader([]byte(migration)))
+	if err != nil {
+		t.Fatalf("ParseMigration: %v", err)
+	}
+
+	if len(parsed.UpStatements) != 1 {
+		t.Fatalf("expected 1 up statement, got %d: %#v", len(parsed.UpStatements), parsed.UpStatements)
+	}
+	if want := "CREATE FUNCTION foo() RETURNS int AS $$\n"; !strings.Contains(parsed.UpStatements[0].Statement, want) {
+		t.Errorf("expected the semicolons inside the nested StatementBegin block to be ignored, got %q", parsed.UpStatements[0].Statement)
+	}
+}
+
+func TestEnvBeginNestedInsideAnotherEnvBeginIsAnError(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=postgres
+-- +migrate EnvBegin dialect=mysql
+SELECT 1;
+-- +migrate EnvEnd
+-- +migrate EnvEnd
+`
+	if _, err := ParseMigration(bytes.NewReader([]byte(migration))); err == nil {
+		t.Fatalf("expected an error for an EnvBegin nested inside another EnvBegin, got nil")
+	}
+}
+
+func TestEnvEndWithUnclosedStatementBeginIsAnError(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=postgres
+-- +migrate StatementBegin
+SELECT 1;
+-- +migrate EnvEnd
+`
+	if _, err := ParseMigration(bytes.NewReader([]byte(migration))); err == nil {
+		t.Fatalf("expected an error for an EnvEnd with an unclosed StatementBegin inside it, got nil")
+	}
+}
+
+func TestDanglingTextInAnExcludedEnvBlockIsAnError(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=mysql
+SELECT 'no terminator here'
+-- +migrate EnvEnd
+SELECT 'rest';
+`
+	p := &Parser{Tags: map[string]string{"dialect": "postgres"}}
+
+	if _, err := p.ParseMigration(bytes.NewReader([]byte(migration))); err == nil {
+		t.Fatalf("expected an error for unterminated text left dangling in an excluded env block, got nil")
+	}
+}
+
+func TestUnclosedEnvBeginIsAnError(t *testing.T) {
+	migration := `-- +migrate Up
+-- +migrate EnvBegin dialect=postgres
+SELECT 1;
+`
+	if _, err := ParseMigration(bytes.NewReader([]byte(migration))); err == nil {
+		t.Fatalf("expected an error for an EnvBegin with no matching EnvEnd, got nil")
+	}
+}
+
+func TestParseStatementsStreamsInFileOrder(t *testing.T) {
+	migration := `-- +migrate Up
+SELECT 1;
+SELECT 2;
+
+-- +migrate Down
+SELECT 3;
+`
+	type seen struct {
+		stmt string
+		down bool
+	}
+	var got []seen
+	err := ParseStatements(bytes.NewReader([]byte(migration)), func(stmt migrationStatement, down bool) error {
+		got = append(got, seen{stmt.Statement, down})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseStatements: %v", err)
+	}
+
+	want := []seen{
+		{"SELECT 1;\n", false},
+		{"SELECT 2;\n", false},
+		{"\nSELECT 3;\n", true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d statements, got %d: %#v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d: got %#v, want %#v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseStatementsStopsOnCallbackError(t *testing.T) {
+	migration := `-- +migrate Up
+SELECT 1;
+SELECT 2;
+`
+	errStop := errors.New("stop here")
+	calls := 0
+	err := ParseStatements(bytes.NewReader([]byte(migration)), func(stmt migrationStatement, down bool) error {
+		calls++
+		return errStop
+	})
+	if err != errStop {
+		t.Fatalf("expected ParseStatements to return the callback's error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected parsing to stop after the first statement, got %d calls", calls)
+	}
+}
+
+func TestParseMigrationDirectionStillValidatesTheSkippedHalf(t *testing.T) {
+	migration := `
+-- +migrate Up
+SELECT 1;
+
+-- +migrate Down
+-- +migrate StatementBegin
+SELECT 2;
+`
+	if _, _, err := ParseMigrationDirection(bytes.NewReader([]byte(migration)), DirectionUp); err == nil {
+		t.Fatalf("expected an error for the unterminated StatementBegin in the unselected Down half, got nil")
+	}
+}